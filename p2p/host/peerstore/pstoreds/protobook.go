@@ -0,0 +1,412 @@
+package pstoreds
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/cespare/xxhash/v2"
+	lru "github.com/hashicorp/golang-lru/v2"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	pstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ErrInvalidPeerID is returned by dsProtoBook methods when called with a
+// peer.ID that fails peer.ID.Validate, mirroring how memoryProtoBook guards
+// against malformed peer IDs.
+var ErrInvalidPeerID = errors.New("invalid peer ID")
+
+// protoBookBase is where we persist the set of protocols supported by each
+// peer, keyed by peer ID: /protobook/<peerID>.
+var protoBookBase = ds.NewKey("/protobook")
+
+// protoBookIdxBase is the secondary index that lets us answer
+// "which peers support protocol X" without scanning every peer record:
+// /protobook-idx/<protoID>/<peerID>.
+var protoBookIdxBase = ds.NewKey("/protobook-idx")
+
+// internCacheSize bounds the number of distinct protocol.ID strings we keep
+// interned in memory, so that repeatedly loading the same protocols off disk
+// doesn't keep allocating new copies of them.
+const internCacheSize = 256
+
+// peerLockShards is the number of granular locks guarding the
+// load-modify-store sequence in dsProtoBook, mirroring the segmented
+// locking design memoryProtoBook uses for its in-memory peer map.
+const peerLockShards = 256
+
+var (
+	errTooManyProtocols = errors.New("too many protocols")
+)
+
+// dsProtoBook is a datastore-backed implementation of pstore.ProtoBook. It
+// mirrors the reverse index that memoryProtoBook keeps in memory, but
+// persists both the per-peer protocol set and the per-protocol peer set
+// under the given datastore, so that a restarted node doesn't need to
+// rediscover which protocols its peers support.
+type dsProtoBook struct {
+	ds ds.Datastore
+
+	maxProtos int
+
+	lk       sync.Mutex
+	interned *lru.Cache[protocol.ID, protocol.ID]
+
+	// peerLocks guards the read-modify-write sequence (loadProtocols then
+	// storeProtocols) for a given peer, so that concurrent mutations of the
+	// same peer's protocol set can't race and clobber one another.
+	peerLocks [peerLockShards]sync.RWMutex
+}
+
+// peerLock returns the lock guarding p's read-modify-write sequence. Shards
+// are chosen by hashing the whole peer ID with xxhash rather than a single
+// byte, so peer IDs sharing a prefix or suffix (common under CIDv1/multihash
+// encodings) don't pile onto the same shard.
+func (pb *dsProtoBook) peerLock(p peer.ID) *sync.RWMutex {
+	h := xxhash.Sum64String(string(p))
+	return &pb.peerLocks[h%uint64(len(pb.peerLocks))]
+}
+
+var _ pstore.ProtoBook = (*dsProtoBook)(nil)
+
+// ProtoBookOption configures a dsProtoBook at construction time.
+type ProtoBookOption func(*dsProtoBook) error
+
+// WithMaxProtocols sets the maximum number of protocols a single peer may be
+// associated with.
+func WithMaxProtocols(num int) ProtoBookOption {
+	return func(pb *dsProtoBook) error {
+		pb.maxProtos = num
+		return nil
+	}
+}
+
+// NewProtoBook creates a new datastore-backed ProtoBook, persisting to the
+// given datastore.
+func NewProtoBook(store ds.Datastore, opts ...ProtoBookOption) (*dsProtoBook, error) {
+	cache, err := lru.New[protocol.ID, protocol.ID](internCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pb := &dsProtoBook{
+		ds:        store,
+		maxProtos: 1024,
+		interned:  cache,
+	}
+
+	for _, opt := range opts {
+		if err := opt(pb); err != nil {
+			return nil, err
+		}
+	}
+
+	return pb, nil
+}
+
+func peerKey(p peer.ID) ds.Key {
+	return protoBookBase.ChildString(p.String())
+}
+
+// encodeProto produces a datastore-key-safe encoding of a protocol.ID. Raw
+// protocol IDs (e.g. "/ipfs/kad/1.0.0") contain path separators that would
+// otherwise be interpreted as nested datastore keys.
+func encodeProto(proto protocol.ID) string {
+	return base32.RawStdEncoding.EncodeToString([]byte(proto))
+}
+
+func protoIdxKey(proto protocol.ID, p peer.ID) ds.Key {
+	return protoBookIdxBase.ChildString(encodeProto(proto)).ChildString(base32.RawStdEncoding.EncodeToString([]byte(p)))
+}
+
+func (pb *dsProtoBook) internProtocol(proto protocol.ID) protocol.ID {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+
+	if interned, ok := pb.interned.Get(proto); ok {
+		return interned
+	}
+	pb.interned.Add(proto, proto)
+	return proto
+}
+
+func encodeProtocols(protos []protocol.ID) []byte {
+	strs := make([]string, len(protos))
+	for i, proto := range protos {
+		strs[i] = string(proto)
+	}
+	return []byte(strings.Join(strs, "\n"))
+}
+
+func decodeProtocols(b []byte) []protocol.ID {
+	if len(b) == 0 {
+		return nil
+	}
+	parts := strings.Split(string(b), "\n")
+	out := make([]protocol.ID, len(parts))
+	for i, s := range parts {
+		out[i] = protocol.ID(s)
+	}
+	return out
+}
+
+func (pb *dsProtoBook) loadProtocols(p peer.ID) (map[protocol.ID]struct{}, error) {
+	val, err := pb.ds.Get(context.Background(), peerKey(p))
+	if errors.Is(err, ds.ErrNotFound) {
+		return make(map[protocol.ID]struct{}), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	decoded := decodeProtocols(val)
+	out := make(map[protocol.ID]struct{}, len(decoded))
+	for _, proto := range decoded {
+		out[pb.internProtocol(proto)] = struct{}{}
+	}
+	return out, nil
+}
+
+// storeProtocols persists the new protocol set for p, and updates the
+// secondary index so that removed protocols drop p and added ones gain it.
+func (pb *dsProtoBook) storeProtocols(p peer.ID, old, new map[protocol.ID]struct{}) error {
+	ctx := context.Background()
+
+	protos := make([]protocol.ID, 0, len(new))
+	for proto := range new {
+		protos = append(protos, proto)
+	}
+
+	if err := pb.ds.Put(ctx, peerKey(p), encodeProtocols(protos)); err != nil {
+		return err
+	}
+
+	for proto := range old {
+		if _, ok := new[proto]; !ok {
+			if err := pb.ds.Delete(ctx, protoIdxKey(proto, p)); err != nil {
+				return err
+			}
+		}
+	}
+	for proto := range new {
+		if _, ok := old[proto]; !ok {
+			if err := pb.ds.Put(ctx, protoIdxKey(proto, p), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (pb *dsProtoBook) SetProtocols(p peer.ID, protos ...protocol.ID) error {
+	if err := p.Validate(); err != nil {
+		return ErrInvalidPeerID
+	}
+	if len(protos) > pb.maxProtos {
+		return errTooManyProtocols
+	}
+
+	lock := pb.peerLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old, err := pb.loadProtocols(p)
+	if err != nil {
+		return err
+	}
+
+	newprotos := make(map[protocol.ID]struct{}, len(protos))
+	for _, proto := range protos {
+		newprotos[pb.internProtocol(proto)] = struct{}{}
+	}
+
+	return pb.storeProtocols(p, old, newprotos)
+}
+
+func (pb *dsProtoBook) AddProtocols(p peer.ID, protos ...protocol.ID) error {
+	if err := p.Validate(); err != nil {
+		return ErrInvalidPeerID
+	}
+
+	lock := pb.peerLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old, err := pb.loadProtocols(p)
+	if err != nil {
+		return err
+	}
+
+	if len(old)+len(protos) > pb.maxProtos {
+		return errTooManyProtocols
+	}
+
+	newprotos := make(map[protocol.ID]struct{}, len(old)+len(protos))
+	for proto := range old {
+		newprotos[proto] = struct{}{}
+	}
+	for _, proto := range protos {
+		newprotos[pb.internProtocol(proto)] = struct{}{}
+	}
+
+	return pb.storeProtocols(p, old, newprotos)
+}
+
+func (pb *dsProtoBook) RemoveProtocols(p peer.ID, protos ...protocol.ID) error {
+	if err := p.Validate(); err != nil {
+		return ErrInvalidPeerID
+	}
+
+	lock := pb.peerLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old, err := pb.loadProtocols(p)
+	if err != nil {
+		return err
+	}
+
+	newprotos := make(map[protocol.ID]struct{}, len(old))
+	for proto := range old {
+		newprotos[proto] = struct{}{}
+	}
+	for _, proto := range protos {
+		delete(newprotos, pb.internProtocol(proto))
+	}
+
+	return pb.storeProtocols(p, old, newprotos)
+}
+
+func (pb *dsProtoBook) GetProtocols(p peer.ID) ([]protocol.ID, error) {
+	if err := p.Validate(); err != nil {
+		return nil, ErrInvalidPeerID
+	}
+
+	lock := pb.peerLock(p)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	protos, err := pb.loadProtocols(p)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]protocol.ID, 0, len(protos))
+	for proto := range protos {
+		out = append(out, proto)
+	}
+	return out, nil
+}
+
+func (pb *dsProtoBook) SupportsProtocols(p peer.ID, protos ...protocol.ID) ([]protocol.ID, error) {
+	if err := p.Validate(); err != nil {
+		return nil, ErrInvalidPeerID
+	}
+
+	lock := pb.peerLock(p)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	have, err := pb.loadProtocols(p)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]protocol.ID, 0, len(protos))
+	for _, proto := range protos {
+		if _, ok := have[proto]; ok {
+			out = append(out, proto)
+		}
+	}
+	return out, nil
+}
+
+func (pb *dsProtoBook) FirstSupportedProtocol(p peer.ID, protos ...protocol.ID) (protocol.ID, error) {
+	if err := p.Validate(); err != nil {
+		return "", ErrInvalidPeerID
+	}
+
+	lock := pb.peerLock(p)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	have, err := pb.loadProtocols(p)
+	if err != nil {
+		return "", err
+	}
+
+	for _, proto := range protos {
+		if _, ok := have[proto]; ok {
+			return proto, nil
+		}
+	}
+	return "", nil
+}
+
+// RemovePeer removes all protocol memberships recorded for p. An invalid
+// peer.ID is treated as a no-op, matching memoryProtoBook's RemovePeer.
+func (pb *dsProtoBook) RemovePeer(p peer.ID) {
+	if err := p.Validate(); err != nil {
+		return
+	}
+
+	lock := pb.peerLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ctx := context.Background()
+
+	old, err := pb.loadProtocols(p)
+	if err != nil {
+		return
+	}
+	for proto := range old {
+		pb.ds.Delete(ctx, protoIdxKey(proto, p))
+	}
+	pb.ds.Delete(ctx, peerKey(p))
+}
+
+// GetPeersForProtocol returns the peers known to support proto, driven off
+// the secondary /protobook-idx index rather than a full scan of every
+// peer's record. Index entries are read from the query one at a time;
+// passing a cancelled or deadlined ctx stops the scan early and returns
+// ctx.Err().
+func (pb *dsProtoBook) GetPeersForProtocol(ctx context.Context, proto protocol.ID) ([]peer.ID, error) {
+	results, err := pb.ds.Query(ctx, query.Query{
+		Prefix:   protoBookIdxBase.ChildString(encodeProto(proto)).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var out []peer.ID
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case e, ok := <-results.Next():
+			if !ok {
+				return out, nil
+			}
+			if e.Error != nil {
+				return nil, e.Error
+			}
+			raw, err := base32.RawStdEncoding.DecodeString(ds.NewKey(e.Key).Name())
+			if err != nil {
+				continue
+			}
+			out = append(out, peer.ID(raw))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package pstoreds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestProtoBookAddGetRoundTrip(t *testing.T) {
+	pb, err := NewProtoBook(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	if err := pb.AddProtocols(p, "/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := pb.GetProtocols(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 protocols, got %v", got)
+	}
+
+	peers, err := pb.GetPeersForProtocol(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != p {
+		t.Fatalf("expected only %q to support /a, got %v", p, peers)
+	}
+}
+
+func TestProtoBookRemoveProtocolsUpdatesIndex(t *testing.T) {
+	pb, err := NewProtoBook(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	if err := pb.AddProtocols(p, "/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.RemoveProtocols(p, "/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := pb.GetPeersForProtocol(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected no peers left for /a, got %v", peers)
+	}
+}
+
+// TestProtoBookConcurrentAddProtocols guards against the load-modify-store
+// race in AddProtocols: many goroutines each adding a distinct protocol for
+// the same peer should all survive, not clobber one another.
+func TestProtoBookConcurrentAddProtocols(t *testing.T) {
+	pb, err := NewProtoBook(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	const n = 64
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			proto := protocol.ID(fmt.Sprintf("/concurrent/%d", i))
+			if err := pb.AddProtocols(p, proto); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := pb.GetProtocols(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("expected %d protocols to survive concurrent adds, got %d: %v", n, len(got), got)
+	}
+
+	for i := 0; i < n; i++ {
+		proto := protocol.ID(fmt.Sprintf("/concurrent/%d", i))
+		peers, err := pb.GetPeersForProtocol(context.Background(), proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0] != p {
+			t.Fatalf("expected %q to be indexed under %q, got %v", p, proto, peers)
+		}
+	}
+}
+
+func TestProtoBookRejectsInvalidPeerID(t *testing.T) {
+	pb, err := NewProtoBook(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const invalid = peer.ID("")
+	const proto = protocol.ID("/test/1.0.0")
+
+	if err := pb.SetProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("SetProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if err := pb.AddProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("AddProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if err := pb.RemoveProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("RemoveProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if _, err := pb.GetProtocols(invalid); err != ErrInvalidPeerID {
+		t.Fatalf("GetProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if _, err := pb.SupportsProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("SupportsProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if _, err := pb.FirstSupportedProtocol(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("FirstSupportedProtocol: expected ErrInvalidPeerID, got %v", err)
+	}
+
+	// RemovePeer must not panic on an empty/invalid peer.ID (it used to index
+	// into the lock shard array with p[len(p)-1]); it's a no-op instead.
+	pb.RemovePeer(invalid)
+}
@@ -3,7 +3,13 @@ package pstoremem
 import (
 	"context"
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	pstore "github.com/libp2p/go-libp2p/core/peerstore"
@@ -15,10 +21,79 @@ type protoSegment struct {
 	protocols map[peer.ID]map[protocol.ID]struct{}
 }
 
-type protoSegments [256]*protoSegment
+// defaultSegmentCount is the number of segments used when the caller doesn't
+// override it via WithSegmentCount.
+const defaultSegmentCount = 256
+
+// vnodesPerSegment is the number of virtual nodes each real segment gets on
+// the hash ring. More virtual nodes spread load more evenly across
+// segments at the cost of a larger ring to search.
+const vnodesPerSegment = 64
+
+// segmentRing maps peer IDs to a segment index via consistent hashing, so
+// that shard load stays balanced even when peer IDs cluster on shared
+// prefixes or suffixes (as CIDv1/multihash-derived IDs commonly do). It is
+// built once at construction and is read-only afterwards, so it needs no
+// locking; it's also reusable by any future secondary index that needs to
+// shard peers the same way the segments do.
+type segmentRing struct {
+	// hashes and shards are parallel slices, sorted by hash, mapping each
+	// virtual node to the real segment it belongs to.
+	hashes []uint64
+	shards []int
+}
+
+func newSegmentRing(numSegments int) *segmentRing {
+	type vnode struct {
+		hash  uint64
+		shard int
+	}
+
+	vnodes := make([]vnode, 0, numSegments*vnodesPerSegment)
+	for shard := 0; shard < numSegments; shard++ {
+		for v := 0; v < vnodesPerSegment; v++ {
+			key := strconv.Itoa(shard) + "-" + strconv.Itoa(v)
+			vnodes = append(vnodes, vnode{hash: xxhash.Sum64String(key), shard: shard})
+		}
+	}
+	sort.Slice(vnodes, func(i, j int) bool { return vnodes[i].hash < vnodes[j].hash })
+
+	r := &segmentRing{
+		hashes: make([]uint64, len(vnodes)),
+		shards: make([]int, len(vnodes)),
+	}
+	for i, vn := range vnodes {
+		r.hashes[i] = vn.hash
+		r.shards[i] = vn.shard
+	}
+	return r
+}
+
+// shardFor returns the segment index p consistently hashes to.
+func (r *segmentRing) shardFor(p peer.ID) int {
+	h := xxhash.Sum64String(string(p))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.shards[i]
+}
+
+type protoSegments struct {
+	segs []*protoSegment
+	ring *segmentRing
+}
+
+func newProtoSegments(numSegments int) protoSegments {
+	segs := make([]*protoSegment, numSegments)
+	for i := range segs {
+		segs[i] = &protoSegment{protocols: make(map[peer.ID]map[protocol.ID]struct{})}
+	}
+	return protoSegments{segs: segs, ring: newSegmentRing(numSegments)}
+}
 
 func (s *protoSegments) get(p peer.ID) *protoSegment {
-	return s[byte(p[len(p)-1])]
+	return s.segs[s.ring.shardFor(p)]
 }
 
 type peersPerProtocol struct {
@@ -29,15 +104,217 @@ type peersPerProtocol struct {
 var errTooManyProtocols = errors.New("too many protocols")
 var errNoPeersForProtocol = errors.New("no peers available for queried protocol")
 
+// ErrInvalidPeerID is returned by memoryProtoBook methods when called with a
+// peer.ID that fails peer.ID.Validate.
+var ErrInvalidPeerID = errors.New("invalid peer ID")
+
+// errEmptyProtocol and errProtocolTooLong are only returned when strict
+// validation is enabled via WithStrictValidation.
+var errEmptyProtocol = errors.New("empty protocol ID")
+var errProtocolTooLong = errors.New("protocol ID exceeds maximum length")
+
+// ProtoEventKind describes whether a ProtoEvent reflects a peer gaining or
+// losing support for a protocol.
+type ProtoEventKind int
+
+const (
+	ProtoEventAdded ProtoEventKind = iota
+	ProtoEventRemoved
+)
+
+// ProtoEvent is emitted on a subscription channel returned by
+// SubscribeProtocolEvents whenever a peer's protocol membership changes.
+// Lagged reports how many events this subscriber has dropped so far because
+// it wasn't keeping up; a consumer can use it to detect that it missed
+// updates.
+type ProtoEvent struct {
+	PeerID   peer.ID
+	Protocol protocol.ID
+	Kind     ProtoEventKind
+	Lagged   uint64
+}
+
+// CancelFunc cancels a subscription created by SubscribeProtocolEvents,
+// releasing its resources and closing its event channel.
+type CancelFunc func()
+
+// protoEventBufSize is the capacity of each subscriber's ring buffer. Once
+// full, the oldest buffered event is dropped to make room for the newest
+// one, so a slow subscriber can never block the ProtoBook write path.
+const protoEventBufSize = 32
+
+type protoEventSub struct {
+	// protos is the set of protocols this subscriber is interested in; a nil
+	// map means "all protocols".
+	protos map[protocol.ID]struct{}
+	ch     chan ProtoEvent
+	lagged uint64 // accessed atomically
+}
+
+func (sub *protoEventSub) send(ev ProtoEvent) {
+	for {
+		ev.Lagged = atomic.LoadUint64(&sub.lagged)
+		select {
+		case sub.ch <- ev:
+			return
+		default:
+		}
+		// buffer is full: drop the oldest event to make room and retry.
+		select {
+		case <-sub.ch:
+			atomic.AddUint64(&sub.lagged, 1)
+		default:
+			// a concurrent receive beat us to it; just retry the send.
+		}
+	}
+}
+
+type protoEventBus struct {
+	mu   sync.Mutex
+	subs map[*protoEventSub]struct{}
+}
+
+func (b *protoEventBus) publish(p peer.ID, proto protocol.ID, kind ProtoEventKind) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		if sub.protos != nil {
+			if _, ok := sub.protos[proto]; !ok {
+				continue
+			}
+		}
+		sub.send(ProtoEvent{PeerID: p, Protocol: proto, Kind: kind})
+	}
+}
+
+// protoTrieNode is a node in a byte-trie over interned protocol.ID strings,
+// used to answer prefix queries (e.g. "every protocol under /ipfs/kad/")
+// without scanning every known protocol. refcount tracks how many peers
+// currently reference a protocol passing through or terminating at this
+// node, so that a branch can be pruned as soon as it becomes empty.
+type protoTrieNode struct {
+	children map[byte]*protoTrieNode
+	terminal bool
+	refcount int
+}
+
+type protoTrie struct {
+	mu   sync.Mutex
+	root *protoTrieNode
+}
+
+func newProtoTrie() *protoTrie {
+	return &protoTrie{root: &protoTrieNode{children: make(map[byte]*protoTrieNode)}}
+}
+
+// insert records one more peer reference to proto.
+func (t *protoTrie) insert(proto protocol.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	n.refcount++
+	for i := 0; i < len(proto); i++ {
+		child, ok := n.children[proto[i]]
+		if !ok {
+			child = &protoTrieNode{children: make(map[byte]*protoTrieNode)}
+			n.children[proto[i]] = child
+		}
+		child.refcount++
+		n = child
+	}
+	n.terminal = true
+}
+
+// remove drops one peer reference to proto, pruning any branch that no
+// longer has peers referencing it.
+func (t *protoTrie) remove(proto protocol.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := make([]*protoTrieNode, len(proto)+1)
+	path[0] = t.root
+	n := t.root
+	for i := 0; i < len(proto); i++ {
+		child, ok := n.children[proto[i]]
+		if !ok {
+			return
+		}
+		path[i+1] = child
+		n = child
+	}
+	if !n.terminal {
+		return
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		path[i].refcount--
+	}
+	// references that end at n are those not passed on to a child.
+	ends := n.refcount
+	for _, child := range n.children {
+		ends -= child.refcount
+	}
+	if ends == 0 {
+		n.terminal = false
+	}
+
+	// prune any branch that no longer has peers referencing it.
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i].refcount == 0 && len(path[i].children) == 0 {
+			delete(path[i-1].children, proto[i-1])
+		}
+	}
+}
+
+// protosWithPrefix returns every protocol whose ID starts with prefix and
+// that is currently referenced by at least one peer.
+func (t *protoTrie) protosWithPrefix(prefix protocol.ID) []protocol.ID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for i := 0; i < len(prefix); i++ {
+		child, ok := n.children[prefix[i]]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+
+	var out []protocol.ID
+	buf := []byte(prefix)
+	var walk func(node *protoTrieNode)
+	walk = func(node *protoTrieNode) {
+		if node.terminal {
+			out = append(out, protocol.ID(append([]byte(nil), buf...)))
+		}
+		for b, child := range node.children {
+			buf = append(buf, b)
+			walk(child)
+			buf = buf[:len(buf)-1]
+		}
+	}
+	walk(n)
+	return out
+}
+
 type memoryProtoBook struct {
 	segments protoSegments
 
-	maxProtos int
+	maxProtos    int
+	segmentCount int
+
+	strict       bool
+	maxProtoSize int
 
 	lk       sync.RWMutex
 	interned map[protocol.ID]protocol.ID
 
-	peers peersPerProtocol
+	peers     peersPerProtocol
+	events    protoEventBus
+	protoTrie *protoTrie
 }
 
 var _ pstore.ProtoBook = (*memoryProtoBook)(nil)
@@ -51,29 +328,110 @@ func WithMaxProtocols(num int) ProtoBookOption {
 	}
 }
 
+// errInvalidSegmentCount is returned by WithSegmentCount when given a
+// non-positive segment count.
+var errInvalidSegmentCount = errors.New("segment count must be greater than zero")
+
+// WithSegmentCount sets the number of segments the peer map is sharded
+// into. Lookups are routed to a segment via a consistent-hash ring built
+// once at construction time, so raising this value trades memory for
+// reduced lock contention on peerstores holding many peers.
+func WithSegmentCount(n int) ProtoBookOption {
+	return func(pb *memoryProtoBook) error {
+		if n <= 0 {
+			return errInvalidSegmentCount
+		}
+		pb.segmentCount = n
+		return nil
+	}
+}
+
+// defaultMaxProtocolLen is the maximum protocol ID length enforced when
+// strict validation is enabled without an explicit WithStrictValidation
+// length.
+const defaultMaxProtocolLen = 256
+
+// WithStrictValidation additionally rejects empty protocol IDs and protocol
+// IDs longer than maxProtocolLen (or defaultMaxProtocolLen, if maxProtocolLen
+// is 0) in SetProtocols and AddProtocols. RemoveProtocols does not apply
+// these checks.
+func WithStrictValidation(maxProtocolLen int) ProtoBookOption {
+	return func(pb *memoryProtoBook) error {
+		pb.strict = true
+		if maxProtocolLen == 0 {
+			maxProtocolLen = defaultMaxProtocolLen
+		}
+		pb.maxProtoSize = maxProtocolLen
+		return nil
+	}
+}
+
 func NewProtoBook(opts ...ProtoBookOption) (*memoryProtoBook, error) {
 	pb := &memoryProtoBook{
-		interned: make(map[protocol.ID]protocol.ID, 256),
-		segments: func() (ret protoSegments) {
-			for i := range ret {
-				ret[i] = &protoSegment{
-					protocols: make(map[peer.ID]map[protocol.ID]struct{}),
-				}
-			}
-			return ret
-		}(),
-		maxProtos: 1024,
+		interned:     make(map[protocol.ID]protocol.ID, 256),
+		maxProtos:    1024,
+		segmentCount: defaultSegmentCount,
 	}
+	pb.events.subs = make(map[*protoEventSub]struct{})
+	pb.protoTrie = newProtoTrie()
 
 	for _, opt := range opts {
 		if err := opt(pb); err != nil {
 			return nil, err
 		}
 	}
+	pb.segments = newProtoSegments(pb.segmentCount)
 	pb.peers.peers = make(map[protocol.ID]map[peer.ID]peer.ID, pb.maxProtos)
 	return pb, nil
 }
 
+// validateProtocols applies WithStrictValidation's rules, when enabled, to
+// protos. It is a no-op when strict validation isn't enabled.
+func (pb *memoryProtoBook) validateProtocols(protos ...protocol.ID) error {
+	if !pb.strict {
+		return nil
+	}
+	for _, proto := range protos {
+		if len(proto) == 0 {
+			return errEmptyProtocol
+		}
+		if len(proto) > pb.maxProtoSize {
+			return errProtocolTooLong
+		}
+	}
+	return nil
+}
+
+// SubscribeProtocolEvents returns a channel of ProtoEvents reporting changes
+// to peers' protocol membership, and a CancelFunc to stop the subscription.
+// If protos is non-empty, only events for those protocols are delivered;
+// otherwise all protocol changes are delivered. The channel is closed once
+// cancel is called; callers must call cancel to avoid leaking the
+// subscription.
+func (pb *memoryProtoBook) SubscribeProtocolEvents(protos ...protocol.ID) (<-chan ProtoEvent, CancelFunc) {
+	sub := &protoEventSub{
+		ch: make(chan ProtoEvent, protoEventBufSize),
+	}
+	if len(protos) > 0 {
+		sub.protos = make(map[protocol.ID]struct{}, len(protos))
+		for _, proto := range protos {
+			sub.protos[pb.internProtocol(proto)] = struct{}{}
+		}
+	}
+
+	pb.events.mu.Lock()
+	pb.events.subs[sub] = struct{}{}
+	pb.events.mu.Unlock()
+
+	cancel := func() {
+		pb.events.mu.Lock()
+		delete(pb.events.subs, sub)
+		pb.events.mu.Unlock()
+		close(sub.ch)
+	}
+	return sub.ch, cancel
+}
+
 func (pb *memoryProtoBook) internProtocol(proto protocol.ID) protocol.ID {
 	// check if it is interned with the read lock
 	pb.lk.RLock()
@@ -99,18 +457,36 @@ func (pb *memoryProtoBook) internProtocol(proto protocol.ID) protocol.ID {
 }
 
 func (pb *memoryProtoBook) SetProtocols(p peer.ID, protos ...protocol.ID) error {
+	if err := p.Validate(); err != nil {
+		return ErrInvalidPeerID
+	}
 	if len(protos) > pb.maxProtos {
 		return errTooManyProtocols
 	}
+	if err := pb.validateProtocols(protos...); err != nil {
+		return err
+	}
 
 	newprotos := make(map[protocol.ID]struct{}, len(protos))
 	for _, proto := range protos {
 		newprotos[pb.internProtocol(proto)] = struct{}{}
 	}
+
 	s := pb.segments.get(p)
 	s.Lock()
+	oldprotos := s.protocols[p]
 	s.protocols[p] = newprotos
 	s.Unlock()
+
+	var dropped []protocol.ID
+	for proto := range oldprotos {
+		if _, ok := newprotos[proto]; !ok {
+			dropped = append(dropped, proto)
+		}
+	}
+	if len(dropped) > 0 {
+		pb.removePeersFromProtocols(p, dropped...)
+	}
 	pb.addPeersPerProtocol(p, protos...)
 	return nil
 }
@@ -124,10 +500,14 @@ func (pb *memoryProtoBook) addPeersPerProtocol(p peer.ID, protos ...protocol.ID)
 			peers = make(map[peer.ID]peer.ID)
 			peers[p] = p
 			pb.peers.peers[proto] = peers
+			pb.protoTrie.insert(proto)
+			pb.events.publish(p, proto, ProtoEventAdded)
 		} else {
 			_, ok := peers[p]
 			if !ok {
 				peers[p] = p
+				pb.protoTrie.insert(proto)
+				pb.events.publish(p, proto, ProtoEventAdded)
 			}
 		}
 	}
@@ -155,6 +535,12 @@ func (pb *memoryProtoBook) addProtocolsToSegment(p peer.ID, protos ...protocol.I
 }
 
 func (pb *memoryProtoBook) AddProtocols(p peer.ID, protos ...protocol.ID) error {
+	if err := p.Validate(); err != nil {
+		return ErrInvalidPeerID
+	}
+	if err := pb.validateProtocols(protos...); err != nil {
+		return err
+	}
 	err := pb.addProtocolsToSegment(p, protos...)
 	if err != nil {
 		return err
@@ -164,6 +550,9 @@ func (pb *memoryProtoBook) AddProtocols(p peer.ID, protos ...protocol.ID) error
 }
 
 func (pb *memoryProtoBook) GetProtocols(p peer.ID) ([]protocol.ID, error) {
+	if err := p.Validate(); err != nil {
+		return nil, ErrInvalidPeerID
+	}
 	s := pb.segments.get(p)
 	s.RLock()
 	defer s.RUnlock()
@@ -198,12 +587,22 @@ func (pb *memoryProtoBook) removePeersFromProtocols(p peer.ID, protos ...protoco
 	defer pb.peers.Unlock()
 	for _, proto := range protos {
 		if peerMap, ok := pb.peers.peers[proto]; ok {
-			delete(peerMap, p)
+			if _, ok := peerMap[p]; ok {
+				delete(peerMap, p)
+				if len(peerMap) == 0 {
+					delete(pb.peers.peers, proto)
+				}
+				pb.protoTrie.remove(proto)
+				pb.events.publish(p, proto, ProtoEventRemoved)
+			}
 		}
 	}
 }
 
 func (pb *memoryProtoBook) RemoveProtocols(p peer.ID, protos ...protocol.ID) error {
+	if err := p.Validate(); err != nil {
+		return ErrInvalidPeerID
+	}
 	err := pb.removeProtocolsFromSegment(p, protos...)
 	if err != nil {
 		return err
@@ -213,6 +612,9 @@ func (pb *memoryProtoBook) RemoveProtocols(p peer.ID, protos ...protocol.ID) err
 }
 
 func (pb *memoryProtoBook) SupportsProtocols(p peer.ID, protos ...protocol.ID) ([]protocol.ID, error) {
+	if err := p.Validate(); err != nil {
+		return nil, ErrInvalidPeerID
+	}
 	s := pb.segments.get(p)
 	s.RLock()
 	defer s.RUnlock()
@@ -228,6 +630,9 @@ func (pb *memoryProtoBook) SupportsProtocols(p peer.ID, protos ...protocol.ID) (
 }
 
 func (pb *memoryProtoBook) FirstSupportedProtocol(p peer.ID, protos ...protocol.ID) (protocol.ID, error) {
+	if err := p.Validate(); err != nil {
+		return "", ErrInvalidPeerID
+	}
 	s := pb.segments.get(p)
 	s.RLock()
 	defer s.RUnlock()
@@ -240,23 +645,38 @@ func (pb *memoryProtoBook) FirstSupportedProtocol(p peer.ID, protos ...protocol.
 	return "", nil
 }
 
+// RemovePeer removes all protocol memberships recorded for p. An invalid
+// peer.ID is treated as a no-op, matching how address books handle removal
+// of peers that were never valid to begin with.
 func (pb *memoryProtoBook) RemovePeer(p peer.ID) {
+	if err := p.Validate(); err != nil {
+		return
+	}
 	s := pb.segments.get(p)
-	//TODO: Is a read lock required for the segment??
+
+	s.Lock()
+	protos := s.protocols[p]
+	delete(s.protocols, p)
+	s.Unlock()
+
+	if len(protos) == 0 {
+		return
+	}
+
 	pb.peers.Lock()
-	for _, protos := range s.protocols {
-		for proto := range protos {
-			if peers, ok := pb.peers.peers[proto]; ok {
+	for proto := range protos {
+		if peers, ok := pb.peers.peers[proto]; ok {
+			if _, ok := peers[p]; ok {
 				delete(peers, p)
+				if len(peers) == 0 {
+					delete(pb.peers.peers, proto)
+				}
+				pb.protoTrie.remove(proto)
+				pb.events.publish(p, proto, ProtoEventRemoved)
 			}
 		}
 	}
 	pb.peers.Unlock()
-
-	s.Lock()
-	delete(s.protocols, p)
-	s.Unlock()
-
 }
 
 func (pb *memoryProtoBook) GetPeersForProtocol(ctx context.Context, proto protocol.ID) ([]peer.ID, error) {
@@ -270,8 +690,58 @@ func (pb *memoryProtoBook) GetPeersForProtocol(ctx context.Context, proto protoc
 	peerIDs := make([]peer.ID, len(peers))
 	i := 0
 	for k := range peers {
-		i++
 		peerIDs[i] = k
+		i++
 	}
 	return peerIDs, nil
 }
+
+// GetPeersForProtocolPrefix returns every peer supporting at least one
+// protocol whose ID starts with prefix, e.g. prefix "/ipfs/kad/" matches
+// peers on any version of the Kademlia protocol. It is backed by a trie
+// index over protocol IDs, so it doesn't need to scan every known protocol.
+func (pb *memoryProtoBook) GetPeersForProtocolPrefix(ctx context.Context, prefix protocol.ID) ([]peer.ID, error) {
+	matches := pb.protoTrie.protosWithPrefix(prefix)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	pb.peers.RLock()
+	defer pb.peers.RUnlock()
+
+	seen := make(map[peer.ID]struct{})
+	for _, proto := range matches {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		for k := range pb.peers.peers[proto] {
+			seen[k] = struct{}{}
+		}
+	}
+
+	out := make([]peer.ID, 0, len(seen))
+	for k := range seen {
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+// SupportsProtocolPrefix reports whether p supports at least one protocol
+// whose ID starts with prefix.
+func (pb *memoryProtoBook) SupportsProtocolPrefix(p peer.ID, prefix protocol.ID) (bool, error) {
+	if err := p.Validate(); err != nil {
+		return false, ErrInvalidPeerID
+	}
+	s := pb.segments.get(p)
+	s.RLock()
+	defer s.RUnlock()
+
+	for proto := range s.protocols[p] {
+		if strings.HasPrefix(string(proto), string(prefix)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,75 @@
+package pstoremem
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// collidingPeerIDs returns n synthetic peer IDs that all share the same
+// trailing byte, the worst case for sharding on p[len(p)-1].
+func collidingPeerIDs(n int) []peer.ID {
+	ids := make([]peer.ID, n)
+	for i := range ids {
+		ids[i] = peer.ID(fmt.Sprintf("bench-peer-%08d\x01", i))
+	}
+	return ids
+}
+
+// BenchmarkGetConcurrentSuffixCollision hammers a shared segment/shard with
+// concurrent reads from peers whose IDs collide on the trailing
+// byte, the pathological case that last-byte sharding suffered from.
+func BenchmarkGetConcurrentSuffixCollision(b *testing.B) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ids := collidingPeerIDs(1024)
+	for _, id := range ids {
+		if err := pb.AddProtocols(id, protocol.ID("/bench/1.0.0")); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pp *testing.PB) {
+		i := 0
+		for pp.Next() {
+			id := ids[i%len(ids)]
+			if _, err := pb.GetProtocols(id); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkAddConcurrentSuffixCollision measures write-path tail latency
+// under the same colliding workload, across all CPUs at once.
+func BenchmarkAddConcurrentSuffixCollision(b *testing.B) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ids := collidingPeerIDs(1024)
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	perGoroutine := b.N / len(ids)
+	if perGoroutine == 0 {
+		perGoroutine = 1
+	}
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				_ = pb.AddProtocols(id, protocol.ID(fmt.Sprintf("/bench/%d.0.0", j)))
+			}
+		}(id)
+	}
+	wg.Wait()
+}
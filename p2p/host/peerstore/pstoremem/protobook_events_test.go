@@ -0,0 +1,125 @@
+package pstoremem
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestSetProtocolsDropsReplacedProtocols(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	protoA := protocol.ID("/a")
+	protoB := protocol.ID("/b")
+
+	if err := pb.SetProtocols(p, protoA); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.SetProtocols(p, protoB); err != nil {
+		t.Fatal(err)
+	}
+
+	peersA, err := pb.GetPeersForProtocol(context.Background(), protoA)
+	if err != errNoPeersForProtocol {
+		t.Fatalf("expected /a to have no peers left, got peers=%v err=%v", peersA, err)
+	}
+
+	peersB, err := pb.GetPeersForProtocol(context.Background(), protoB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peersB) != 1 || peersB[0] != p {
+		t.Fatalf("expected only %q to support /b, got %v", p, peersB)
+	}
+
+	if has, err := pb.SupportsProtocolPrefix(p, protocol.ID("/a")); err != nil || has {
+		t.Fatalf("expected peer to no longer support /a, has=%v err=%v", has, err)
+	}
+}
+
+func TestSetProtocolsPublishesAddedAndRemovedEvents(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	protoA := protocol.ID("/a")
+	protoB := protocol.ID("/b")
+
+	if err := pb.SetProtocols(p, protoA); err != nil {
+		t.Fatal(err)
+	}
+
+	events, cancel := pb.SubscribeProtocolEvents()
+	defer cancel()
+
+	if err := pb.SetProtocols(p, protoB); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotAdded, gotRemoved bool
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-events:
+			switch ev.Kind {
+			case ProtoEventAdded:
+				if ev.Protocol != protoB {
+					t.Fatalf("expected added event for /b, got %v", ev)
+				}
+				gotAdded = true
+			case ProtoEventRemoved:
+				if ev.Protocol != protoA {
+					t.Fatalf("expected removed event for /a, got %v", ev)
+				}
+				gotRemoved = true
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for protocol event")
+		}
+	}
+
+	if !gotAdded || !gotRemoved {
+		t.Fatalf("expected both an added and a removed event, gotAdded=%v gotRemoved=%v", gotAdded, gotRemoved)
+	}
+}
+
+func TestSubscribeProtocolEventsLaggedCounter(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	events, cancel := pb.SubscribeProtocolEvents()
+	defer cancel()
+
+	// Flood past the subscriber's buffer without draining it, forcing drops.
+	for i := 0; i < protoEventBufSize+8; i++ {
+		proto := protocol.ID(fmt.Sprintf("/flood/%d", i))
+		if err := pb.AddProtocols(p, proto); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last ProtoEvent
+	for {
+		select {
+		case ev := <-events:
+			last = ev
+		default:
+			if last.Lagged == 0 {
+				t.Fatal("expected a lagged subscriber to report dropped events")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pstoremem
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestRemovePeerClearsProtocolsAndIndex(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	other := peer.ID("peer-2")
+	proto := protocol.ID("/a")
+
+	if err := pb.AddProtocols(p, proto); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.AddProtocols(other, proto); err != nil {
+		t.Fatal(err)
+	}
+
+	pb.RemovePeer(p)
+
+	if got, err := pb.GetProtocols(p); err != nil || len(got) != 0 {
+		t.Fatalf("expected no protocols left for removed peer, got %v err=%v", got, err)
+	}
+
+	peers, err := pb.GetPeersForProtocol(context.Background(), proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != other {
+		t.Fatalf("expected only %q to still support %q, got %v", other, proto, peers)
+	}
+}
+
+// TestConcurrentAddProtocolsAndRemovePeer exercises AddProtocols and
+// RemovePeer racing on peers that share a segment. Run with -race: RemovePeer
+// used to range over the shared segment map without holding its lock, which
+// is a concurrent map read/write as soon as another goroutine mutates the
+// same segment.
+func TestConcurrentAddProtocolsAndRemovePeer(t *testing.T) {
+	pb, err := NewProtoBook(WithSegmentCount(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 32
+	peers := make([]peer.ID, n)
+	for i := range peers {
+		peers[i] = peer.ID(fmt.Sprintf("peer-%d", i))
+	}
+
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p peer.ID) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				proto := protocol.ID(fmt.Sprintf("/stress/%d/%d", i, j))
+				if err := pb.AddProtocols(p, proto); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%5 == 0 {
+					pb.RemovePeer(p)
+				}
+			}
+		}(i, p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,131 @@
+package pstoremem
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestGetPeersForProtocol(t *testing.T) {
+	const proto = protocol.ID("/test/1.0.0")
+
+	cases := []struct {
+		name      string
+		numPeers  int
+		wantEmpty bool
+	}{
+		{name: "zero peers", numPeers: 0, wantEmpty: true},
+		{name: "one peer", numPeers: 1},
+		{name: "many peers", numPeers: 8},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pb, err := NewProtoBook()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]peer.ID, 0, tc.numPeers)
+			for i := 0; i < tc.numPeers; i++ {
+				id := peer.ID(fmt.Sprintf("peer-%d", i))
+				if err := pb.AddProtocols(id, proto); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, id)
+			}
+
+			got, err := pb.GetPeersForProtocol(context.Background(), proto)
+			if tc.wantEmpty {
+				if err != errNoPeersForProtocol {
+					t.Fatalf("expected errNoPeersForProtocol, got %v (peers=%v)", err, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("expected %d peers, got %d: %v", len(want), len(got), got)
+			}
+
+			seen := make(map[peer.ID]bool, len(got))
+			for _, id := range got {
+				if id == "" {
+					t.Fatalf("got zero-valued peer.ID in result: %v", got)
+				}
+				seen[id] = true
+			}
+			for _, id := range want {
+				if !seen[id] {
+					t.Fatalf("missing expected peer %q in result %v", id, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProtoBookRejectsInvalidPeerID(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const invalid = peer.ID("")
+	const proto = protocol.ID("/test/1.0.0")
+
+	if err := pb.SetProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("SetProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if err := pb.AddProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("AddProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if err := pb.RemoveProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("RemoveProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if _, err := pb.GetProtocols(invalid); err != ErrInvalidPeerID {
+		t.Fatalf("GetProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if _, err := pb.SupportsProtocols(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("SupportsProtocols: expected ErrInvalidPeerID, got %v", err)
+	}
+	if _, err := pb.FirstSupportedProtocol(invalid, proto); err != ErrInvalidPeerID {
+		t.Fatalf("FirstSupportedProtocol: expected ErrInvalidPeerID, got %v", err)
+	}
+
+	// RemovePeer is a no-op for invalid peer IDs rather than erroring.
+	pb.RemovePeer(invalid)
+}
+
+func TestProtoBookStrictValidation(t *testing.T) {
+	pb, err := NewProtoBook(WithStrictValidation(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	if err := pb.AddProtocols(p, protocol.ID("")); err != errEmptyProtocol {
+		t.Fatalf("expected errEmptyProtocol, got %v", err)
+	}
+	if err := pb.AddProtocols(p, protocol.ID("/way/too/long")); err != errProtocolTooLong {
+		t.Fatalf("expected errProtocolTooLong, got %v", err)
+	}
+	if err := pb.AddProtocols(p, protocol.ID("/ok")); err != nil {
+		t.Fatalf("expected valid protocol to be accepted, got %v", err)
+	}
+}
+
+func TestWithSegmentCountRejectsNonPositive(t *testing.T) {
+	if _, err := NewProtoBook(WithSegmentCount(0)); err == nil {
+		t.Fatal("expected WithSegmentCount(0) to error")
+	}
+	if _, err := NewProtoBook(WithSegmentCount(-1)); err == nil {
+		t.Fatal("expected WithSegmentCount(-1) to error")
+	}
+	if _, err := NewProtoBook(WithSegmentCount(4)); err != nil {
+		t.Fatalf("expected a positive segment count to be accepted, got %v", err)
+	}
+}
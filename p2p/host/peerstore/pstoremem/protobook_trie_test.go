@@ -0,0 +1,169 @@
+package pstoremem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func sortedPeers(ids []peer.ID) []peer.ID {
+	out := append([]peer.ID(nil), ids...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func TestGetPeersForProtocolPrefix(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kadPeer := peer.ID("kad-peer")
+	meshPeer := peer.ID("mesh-peer")
+	bothPeer := peer.ID("both-peer")
+
+	if err := pb.AddProtocols(kadPeer, "/ipfs/kad/1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.AddProtocols(meshPeer, "/meshsub/1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.AddProtocols(bothPeer, "/ipfs/kad/2.0.0", "/meshsub/1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	kadPeers, err := pb.GetPeersForProtocolPrefix(context.Background(), "/ipfs/kad/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sortedPeers([]peer.ID{kadPeer, bothPeer})
+	got := sortedPeers(kadPeers)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	meshPeers, err := pb.GetPeersForProtocolPrefix(context.Background(), "/meshsub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = sortedPeers([]peer.ID{meshPeer, bothPeer})
+	got = sortedPeers(meshPeers)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	none, err := pb.GetPeersForProtocolPrefix(context.Background(), "/unknown/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(none) != 0 {
+		t.Fatalf("expected no peers for unknown prefix, got %v", none)
+	}
+}
+
+func TestSupportsProtocolPrefix(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	if err := pb.AddProtocols(p, "/ipfs/kad/1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	has, err := pb.SupportsProtocolPrefix(p, "/ipfs/kad/")
+	if err != nil || !has {
+		t.Fatalf("expected peer to support /ipfs/kad/ prefix, has=%v err=%v", has, err)
+	}
+
+	has, err = pb.SupportsProtocolPrefix(p, "/meshsub/")
+	if err != nil || has {
+		t.Fatalf("expected peer not to support /meshsub/ prefix, has=%v err=%v", has, err)
+	}
+}
+
+// TestProtoTriePrunesRemovedBranches verifies that removing a protocol
+// doesn't leave it (or dangling nodes) behind in the trie, while protocols
+// that share a prefix with it keep working.
+func TestProtoTriePrunesRemovedBranches(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer-1")
+	if err := pb.AddProtocols(p, "/ipfs/kad/1.0.0", "/ipfs/kad/2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pb.RemoveProtocols(p, "/ipfs/kad/1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := pb.GetPeersForProtocolPrefix(context.Background(), "/ipfs/kad/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected removed protocol to be pruned from the trie, got %v", peers)
+	}
+
+	// The sibling protocol under the same prefix must still resolve.
+	peers, err = pb.GetPeersForProtocolPrefix(context.Background(), "/ipfs/kad/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != p {
+		t.Fatalf("expected %q to still support /ipfs/kad/2.0.0, got %v", p, peers)
+	}
+
+	if err := pb.RemoveProtocols(p, "/ipfs/kad/2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if pb.protoTrie.root.refcount != 0 {
+		t.Fatalf("expected trie to be fully pruned back to an empty root, refcount=%d", pb.protoTrie.root.refcount)
+	}
+	if len(pb.protoTrie.root.children) != 0 {
+		t.Fatalf("expected trie root to have no children left, got %v", pb.protoTrie.root.children)
+	}
+}
+
+func TestProtoTrieConcurrentInsertRemove(t *testing.T) {
+	pb, err := NewProtoBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := peer.ID(fmt.Sprintf("peer-%d", i))
+			proto := protocol.ID(fmt.Sprintf("/concurrent/prefix/%d", i))
+			if err := pb.AddProtocols(p, proto); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := pb.RemoveProtocols(p, proto); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	peers, err := pb.GetPeersForProtocolPrefix(context.Background(), "/concurrent/prefix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected no peers left after add+remove pairs, got %v", peers)
+	}
+}